@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/vanilla-os/abroot/core"
+)
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2023
+	Description:
+		history exposes core.UpdateHistory's persisted upgrade attempts
+		to the CLI, so a user can inspect or prune them without reaching
+		into /var/lib/abroot/history by hand.
+*/
+
+// NewHistoryCommand returns the "abroot history" command and its
+// list/show/prune subcommands
+func NewHistoryCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "Inspect past and in-progress upgrade attempts",
+	}
+
+	cmd.AddCommand(newHistoryListCommand())
+	cmd.AddCommand(newHistoryShowCommand())
+	cmd.AddCommand(newHistoryPruneCommand())
+
+	return cmd
+}
+
+func newHistoryListCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List every recorded upgrade attempt, most recent first",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			records, err := core.ListHistory()
+			if err != nil {
+				return err
+			}
+
+			for _, record := range records {
+				fmt.Printf("%s\t%s\t%s\t%s\n", record.ID, record.State, record.Stage, record.StartedAt)
+			}
+
+			return nil
+		},
+	}
+}
+
+func newHistoryShowCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "show <id>",
+		Short: "Show the full record for a single upgrade attempt",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			record, err := core.ShowHistory(args[0])
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("id:            %s\n", record.ID)
+			fmt.Printf("state:         %s\n", record.State)
+			fmt.Printf("stage:         %s\n", record.Stage)
+			fmt.Printf("started_at:    %s\n", record.StartedAt)
+			fmt.Printf("digest_from:   %s\n", record.DigestFrom)
+			fmt.Printf("digest_to:     %s\n", record.DigestTo)
+			fmt.Printf("artifact_path: %s\n", record.ArtifactPath)
+			if record.Error != "" {
+				fmt.Printf("error:         %s\n", record.Error)
+			}
+
+			return nil
+		},
+	}
+}
+
+func newHistoryPruneCommand() *cobra.Command {
+	var keep int
+
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove non-pending history records beyond the most recent ones",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return core.PruneHistory(keep)
+		},
+	}
+
+	cmd.Flags().IntVar(&keep, "keep", core.HistoryRecordsToKeep, "number of non-pending records to keep")
+
+	return cmd
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/vanilla-os/abroot/core"
+)
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2023
+	Description:
+		rollback drives ABSystem.Rollback from the CLI.
+*/
+
+// NewRollbackCommand returns the "abroot rollback" command
+func NewRollbackCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rollback",
+		Short: "Roll the system back to the previously booted root",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := core.NewABSystem()
+			if err != nil {
+				return err
+			}
+
+			return s.Rollback()
+		},
+	}
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/vanilla-os/abroot/core"
+)
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2023
+	Description:
+		upgrade drives ABSystem.Upgrade and ABSystem.Resume from the CLI.
+*/
+
+// NewUpgradeCommand returns the "abroot upgrade" command
+func NewUpgradeCommand() *cobra.Command {
+	var resume bool
+
+	cmd := &cobra.Command{
+		Use:   "upgrade",
+		Short: "Upgrade the system to the latest available image",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := core.NewABSystem()
+			if err != nil {
+				return err
+			}
+
+			if resume {
+				return s.Resume()
+			}
+
+			return s.Upgrade()
+		},
+	}
+
+	cmd.Flags().BoolVar(&resume, "resume", false, "resume a previously interrupted upgrade instead of starting a new one")
+
+	return cmd
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2023
+	Description:
+		Records the UKI digest produced by SystemdBootUKI.GenerateEntry
+		into the rootfs's own abimage.abr, so it survives alongside the
+		rest of the image metadata rather than only as an ESP-side
+		sidecar file.
+*/
+
+// ukiDigestField is the abimage.abr field recordUKIDigest writes
+const ukiDigestField = "uki_sha256"
+
+// recordUKIDigest adds or updates the sha256 digest of the promoted UKI
+// in the abimage.abr found at rootPath. It edits the file as generic
+// JSON rather than through the ABImage type, since the digest is an
+// EFI/UKI-specific concern the GRUB backend has no use for
+func recordUKIDigest(rootPath string, digest string) error {
+	PrintVerbose("recordUKIDigest: recording %s", digest)
+
+	path := filepath.Join(rootPath, "abimage.abr")
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		PrintVerbose("recordUKIDigest:err: %s", err)
+		return err
+	}
+
+	var meta map[string]interface{}
+	err = json.Unmarshal(bytes, &meta)
+	if err != nil {
+		PrintVerbose("recordUKIDigest:err(2): %s", err)
+		return err
+	}
+
+	meta[ukiDigestField] = digest
+
+	out, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		PrintVerbose("recordUKIDigest:err(3): %s", err)
+		return err
+	}
+
+	err = os.WriteFile(path, out, 0644)
+	if err != nil {
+		PrintVerbose("recordUKIDigest:err(4): %s", err)
+		return err
+	}
+
+	return nil
+}
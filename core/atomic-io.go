@@ -16,6 +16,7 @@ package core
 
 import (
 	"os"
+	"strings"
 
 	"golang.org/x/sys/unix"
 )
@@ -46,3 +47,30 @@ func AtomicSwap(src, dst string) error {
 
 	return nil
 }
+
+// isMounted reports whether path is currently a mountpoint, by scanning
+// /proc/mounts. Used to make a Mount call idempotent across a Resume:
+// the mount itself doesn't survive a reboot even though the history
+// checkpoint that gated it does, so callers need to tell "still mounted
+// from before the crash" apart from "needs mounting again"
+func isMounted(path string) bool {
+	data, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		PrintVerbose("isMounted:err: %s", err)
+		return false
+	}
+
+	target := strings.TrimRight(path, "/")
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		if strings.TrimRight(fields[1], "/") == target {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"github.com/vanilla-os/abroot/settings"
+)
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2023
+	Description:
+		Bootloader abstracts away the boot manager ABSystem.Upgrade
+		promotes A/B roots with, so GRUB-based and EFI-only (systemd-boot
+		+ UKI) setups can share the same upgrade pipeline.
+*/
+
+// Bootloader is implemented by every boot manager backend ABRoot can
+// drive during ABSystem.Upgrade
+type Bootloader interface {
+	// GenerateEntry (re)generates whatever this backend needs to boot
+	// rootPath under the given root identifier ("a" or "b"), staging it
+	// so it only takes effect once AtomicPromote is called. It returns
+	// the sha256 digest of the staged boot artifact, or "" for backends
+	// (like GRUB) that don't produce one to record
+	GenerateEntry(rootPath string, rootUuid string, entryName string, root string) (string, error)
+
+	// InstallFromChroot runs the backend's install tooling, if any,
+	// inside the given chroot (e.g. grub-mkconfig)
+	InstallFromChroot(c *Chroot) error
+
+	// AtomicPromote makes the entry staged by GenerateEntry the one
+	// booted next, swapping it in on the boot partition mounted at
+	// bootMount
+	AtomicPromote(bootMount string) error
+}
+
+// NewBootloader returns the Bootloader backend selected via
+// settings.Cnf.Bootloader, defaulting to GRUB when unset or unrecognized
+func NewBootloader() Bootloader {
+	PrintVerbose("NewBootloader: selecting backend %s", settings.Cnf.Bootloader)
+
+	switch settings.Cnf.Bootloader {
+	case "systemd-boot", "uki":
+		return NewSystemdBootUKI()
+	default:
+		return &GrubBootloader{}
+	}
+}
+
+// GrubBootloader is the original ABRoot backend: it renders a GRUB
+// 10_abroot recipe and runs grub-mkconfig inside the chroot
+type GrubBootloader struct{}
+
+// GenerateEntry renders the 10_abroot recipe for root, see
+// generateGrubRecipe. GRUB has no single boot artifact to digest, so it
+// always returns an empty digest
+func (g *GrubBootloader) GenerateEntry(rootPath string, rootUuid string, entryName string, root string) (string, error) {
+	return "", generateGrubRecipe(rootPath, rootUuid, entryName, root)
+}
+
+// InstallFromChroot runs grub-mkconfig inside the future root's chroot
+func (g *GrubBootloader) InstallFromChroot(c *Chroot) error {
+	return c.ExecuteCmds([]string{
+		"grub-mkconfig -o /boot/grub/grub.cfg",
+		"exit",
+	})
+}
+
+// AtomicPromote swaps grub.cfg with the grub.cfg.future generated by
+// InstallFromChroot
+func (g *GrubBootloader) AtomicPromote(bootMount string) error {
+	return AtomicSwap(bootMount+"/grub.cfg", bootMount+"/grub.cfg.future")
+}
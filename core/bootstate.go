@@ -0,0 +1,150 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2023
+	Description:
+		BootState tracks, across reboots, whether the root partition that
+		was just promoted by ABSystem.Upgrade actually came up correctly.
+		It is the Go-side counterpart of the small GRUB env block that
+		10_abroot reads to decide which of the two roots to boot, and by
+		how many tries it is still allowed to fail.
+*/
+
+// bootStateFileName is the base name, without the .json extension, of
+// the state file persisted next to grub.cfg on the boot partition
+const bootStateFileName = "abroot-state"
+
+// defaultTriesLeft is the number of boot attempts granted to a root
+// right after it has been promoted, before GRUB falls back to the
+// other one
+const defaultTriesLeft = 3
+
+// PartitionBootState is the boot-counting state of a single root
+// partition (A or B)
+type PartitionBootState struct {
+	TriesLeft    int    `json:"tries_left"`
+	Priority     int    `json:"priority"`
+	Successful   bool   `json:"successful"`
+	PreviousRoot string `json:"previous_root"`
+}
+
+// BootState is the on-disk representation of abroot-state.json
+type BootState struct {
+	A PartitionBootState `json:"a"`
+	B PartitionBootState `json:"b"`
+}
+
+// NewBootState reads abroot-state.json from bootMount, or returns a
+// fresh state favouring partition A if no state file exists yet, e.g.
+// on a freshly installed system
+func NewBootState(bootMount string) (*BootState, error) {
+	PrintVerbose("NewBootState: running...")
+
+	statePath := filepath.Join(bootMount, bootStateFileName+".json")
+	bytes, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		PrintVerbose("NewBootState: no state file found, using default")
+		return &BootState{
+			A: PartitionBootState{TriesLeft: defaultTriesLeft, Priority: 10, Successful: true},
+			B: PartitionBootState{TriesLeft: defaultTriesLeft, Priority: 5, Successful: true},
+		}, nil
+	}
+	if err != nil {
+		PrintVerbose("NewBootState:err: %s", err)
+		return nil, err
+	}
+
+	var state BootState
+	err = json.Unmarshal(bytes, &state)
+	if err != nil {
+		PrintVerbose("NewBootState:err(2): %s", err)
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// WriteTo writes the state to bootMount/abroot-state.json, or, when
+// suffix is not empty, to bootMount/abroot-state-<suffix>.json, so that
+// callers can stage a new state file and AtomicSwap it in next to
+// grub.cfg
+func (b *BootState) WriteTo(bootMount string, suffix string) error {
+	PrintVerbose("BootState.WriteTo: running...")
+
+	name := bootStateFileName
+	if suffix != "" {
+		name += "-" + suffix
+	}
+
+	bytes, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		PrintVerbose("BootState.WriteTo:err: %s", err)
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(bootMount, name+".json"), bytes, 0644)
+	if err != nil {
+		PrintVerbose("BootState.WriteTo:err(2): %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// entryFor returns a pointer to the PartitionBootState for the given
+// root identifier ("a" or "b"), so callers can mutate it in place
+func (b *BootState) entryFor(root string) (*PartitionBootState, error) {
+	switch strings.ToLower(root) {
+	case "a":
+		return &b.A, nil
+	case "b":
+		return &b.B, nil
+	default:
+		return nil, errors.New("BootState.entryFor: unknown root identifier: " + root)
+	}
+}
+
+// otherRoot returns "b" when given "a" and vice-versa
+func otherRoot(root string) string {
+	if strings.ToLower(root) == "a" {
+		return "b"
+	}
+	return "a"
+}
+
+// WriteGrubEnv pushes the current priorities and try counts into GRUB's
+// environment block at envFile via grub-editenv, so 10_abroot can pick
+// the right entry without having to parse abroot-state.json itself
+func (b *BootState) WriteGrubEnv(envFile string) error {
+	PrintVerbose("BootState.WriteGrubEnv: running...")
+
+	vars := map[string]string{
+		"abroot_a_tries_left": strconv.Itoa(b.A.TriesLeft),
+		"abroot_a_priority":   strconv.Itoa(b.A.Priority),
+		"abroot_b_tries_left": strconv.Itoa(b.B.TriesLeft),
+		"abroot_b_priority":   strconv.Itoa(b.B.Priority),
+	}
+
+	for k, v := range vars {
+		err := exec.Command("grub-editenv", envFile, "set", k+"="+v).Run()
+		if err != nil {
+			PrintVerbose("BootState.WriteGrubEnv:err: %s", err)
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBootStateRoundTrip(t *testing.T) {
+	bootMount := t.TempDir()
+
+	state, err := NewBootState(bootMount)
+	if err != nil {
+		t.Fatalf("NewBootState() error = %s", err)
+	}
+
+	state.A.TriesLeft = 1
+	state.A.Priority = 11
+	state.A.Successful = false
+	state.A.PreviousRoot = "b"
+
+	if err := state.WriteTo(bootMount, ""); err != nil {
+		t.Fatalf("WriteTo() error = %s", err)
+	}
+
+	reloaded, err := NewBootState(bootMount)
+	if err != nil {
+		t.Fatalf("NewBootState() (reload) error = %s", err)
+	}
+
+	if reloaded.A != state.A {
+		t.Errorf("reloaded A = %+v, want %+v", reloaded.A, state.A)
+	}
+}
+
+func TestBootStateWriteToSuffix(t *testing.T) {
+	bootMount := t.TempDir()
+
+	state := &BootState{A: PartitionBootState{Priority: 1}, B: PartitionBootState{Priority: 2}}
+	if err := state.WriteTo(bootMount, "new"); err != nil {
+		t.Fatalf("WriteTo() error = %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(bootMount, "abroot-state.json")); !os.IsNotExist(err) {
+		t.Error("WriteTo(suffix=new) also wrote the unsuffixed abroot-state.json")
+	}
+
+	bytes, err := os.ReadFile(filepath.Join(bootMount, "abroot-state-new.json"))
+	if err != nil {
+		t.Fatalf("WriteTo(suffix=new) did not write abroot-state-new.json: %s", err)
+	}
+
+	var got BootState
+	if err := json.Unmarshal(bytes, &got); err != nil {
+		t.Fatalf("failed to unmarshal abroot-state-new.json: %s", err)
+	}
+	if got != *state {
+		t.Errorf("abroot-state-new.json = %+v, want %+v", got, *state)
+	}
+}
+
+func TestNewBootStateDefaultsWhenMissing(t *testing.T) {
+	state, err := NewBootState(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewBootState() error = %s", err)
+	}
+
+	if state.A.TriesLeft != defaultTriesLeft || state.A.Priority != 10 {
+		t.Errorf("default A = %+v, want tries_left=%d priority=10", state.A, defaultTriesLeft)
+	}
+	if state.B.TriesLeft != defaultTriesLeft || state.B.Priority != 5 {
+		t.Errorf("default B = %+v, want tries_left=%d priority=5", state.B, defaultTriesLeft)
+	}
+}
+
+func TestEntryFor(t *testing.T) {
+	state := &BootState{A: PartitionBootState{Priority: 1}, B: PartitionBootState{Priority: 2}}
+
+	a, err := state.entryFor("A")
+	if err != nil {
+		t.Fatalf("entryFor(A) error = %s", err)
+	}
+	if a != &state.A {
+		t.Errorf("entryFor(A) did not return a pointer to state.A")
+	}
+
+	b, err := state.entryFor("b")
+	if err != nil {
+		t.Fatalf("entryFor(b) error = %s", err)
+	}
+	if b != &state.B {
+		t.Errorf("entryFor(b) did not return a pointer to state.B")
+	}
+
+	if _, err := state.entryFor("c"); err == nil {
+		t.Error("entryFor(c) expected an error for an unknown root, got nil")
+	}
+}
+
+func TestOtherRoot(t *testing.T) {
+	if got := otherRoot("a"); got != "b" {
+		t.Errorf("otherRoot(a) = %q, want b", got)
+	}
+	if got := otherRoot("A"); got != "b" {
+		t.Errorf("otherRoot(A) = %q, want b", got)
+	}
+	if got := otherRoot("b"); got != "a" {
+		t.Errorf("otherRoot(b) = %q, want a", got)
+	}
+}
@@ -1,10 +1,15 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strings"
+
+	"github.com/vanilla-os/abroot/settings"
 )
 
 // Chroot is a struct which represents a chroot environment
@@ -12,6 +17,15 @@ type Chroot struct {
 	root       string
 	rootUuid   string
 	rootDevice string
+
+	// Arch is the architecture of root, e.g. "aarch64". Empty means
+	// "same as the host"
+	Arch string
+
+	// foreignMounts are the extra bind mounts set up to emulate a
+	// foreign Arch (currently just the qemu-user-static binary), torn
+	// down by Close in reverse order
+	foreignMounts []string
 }
 
 var ReservedMounts = []string{
@@ -22,8 +36,19 @@ var ReservedMounts = []string{
 	"/sys",
 }
 
-// NewChroot creates a new chroot environment
-func NewChroot(root string, rootUuid string, rootDevice string) (*Chroot, error) {
+// qemuBinfmtMagic maps a foreign architecture to the binfmt_misc
+// registration string (magic/mask pair) qemu-user-static ships for it
+var qemuBinfmtMagic = map[string]string{
+	"aarch64": `:qemu-aarch64:M::\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00:\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff:%s:OCF`,
+	"riscv64": `:qemu-riscv64:M::\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xf3\x00:\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff:%s:OCF`,
+}
+
+// NewChroot creates a new chroot environment. When arch is given and
+// differs from runtime.GOARCH, a binfmt_misc entry and a bind-mounted
+// qemu-<arch>-static are set up first so root/bin/sh can be emulated
+// transparently, enabling e.g. building an aarch64 root on an x86_64
+// host
+func NewChroot(root string, rootUuid string, rootDevice string, arch ...string) (*Chroot, error) {
 	PrintVerbose("NewChroot: running...")
 
 	root = strings.ReplaceAll(root, "//", "/")
@@ -33,10 +58,24 @@ func NewChroot(root string, rootUuid string, rootDevice string) (*Chroot, error)
 		return nil, err
 	}
 
+	targetArch := ""
+	if len(arch) > 0 {
+		targetArch = arch[0]
+	}
+
 	chroot := &Chroot{
 		root:       root,
 		rootUuid:   rootUuid,
 		rootDevice: rootDevice,
+		Arch:       targetArch,
+	}
+
+	if targetArch != "" && targetArch != runtime.GOARCH {
+		err := chroot.setupForeignArch(targetArch)
+		if err != nil {
+			PrintVerbose("NewChroot:err(1.1): " + err.Error())
+			return nil, err
+		}
 	}
 
 	// workaround for grub-mkconfig, not able to find the device
@@ -60,10 +99,79 @@ func NewChroot(root string, rootUuid string, rootDevice string) (*Chroot, error)
 	return chroot, nil
 }
 
-// Close unmounts all the bind mounts
+// setupForeignArch registers a binfmt_misc handler for arch, if not
+// already registered, then bind-mounts a statically-linked
+// qemu-<arch>-static into root/usr/bin/ so the chroot's /bin/sh can be
+// transparently emulated
+func (c *Chroot) setupForeignArch(arch string) error {
+	PrintVerbose("Chroot.setupForeignArch: setting up emulation for %s", arch)
+
+	err := registerBinfmtMisc(arch)
+	if err != nil {
+		PrintVerbose("Chroot.setupForeignArch:err: " + err.Error())
+		return err
+	}
+
+	qemuStaticDir := settings.Cnf.QemuStaticPath
+	if qemuStaticDir == "" {
+		qemuStaticDir = "/usr/bin"
+	}
+
+	qemuBinaryName := "qemu-" + arch + "-static"
+	qemuSrc := filepath.Join(qemuStaticDir, qemuBinaryName)
+	qemuDst := filepath.Join(c.root, "usr", "bin", qemuBinaryName)
+
+	if _, err := os.Stat(qemuDst); os.IsNotExist(err) {
+		f, err := os.OpenFile(qemuDst, os.O_CREATE, 0755)
+		if err != nil {
+			PrintVerbose("Chroot.setupForeignArch:err(2): " + err.Error())
+			return err
+		}
+		f.Close()
+	}
+
+	err = exec.Command("mount", "--bind", qemuSrc, qemuDst).Run()
+	if err != nil {
+		PrintVerbose("Chroot.setupForeignArch:err(3): " + err.Error())
+		return err
+	}
+
+	c.foreignMounts = append(c.foreignMounts, qemuDst)
+
+	return nil
+}
+
+// registerBinfmtMisc registers arch's qemu-user-static handler under
+// /proc/sys/fs/binfmt_misc, unless it is already registered
+func registerBinfmtMisc(arch string) error {
+	magic, ok := qemuBinfmtMagic[arch]
+	if !ok {
+		return errors.New("unsupported foreign architecture: " + arch)
+	}
+
+	entryPath := filepath.Join("/proc/sys/fs/binfmt_misc", "qemu-"+arch)
+	if _, err := os.Stat(entryPath); err == nil {
+		PrintVerbose("registerBinfmtMisc: %s already registered", arch)
+		return nil
+	}
+
+	registration := fmt.Sprintf(magic, "/usr/bin/qemu-"+arch+"-static")
+	return os.WriteFile("/proc/sys/fs/binfmt_misc/register", []byte(registration), 0644)
+}
+
+// Close unmounts all the bind mounts: the foreign-arch ones first, in
+// reverse order of mounting, then the ReservedMounts
 func (c *Chroot) Close() error {
 	PrintVerbose("Chroot.Close: running...")
 
+	for i := len(c.foreignMounts) - 1; i >= 0; i-- {
+		err := exec.Command("umount", c.foreignMounts[i]).Run()
+		if err != nil {
+			PrintVerbose("Chroot.Close:err(0): " + err.Error())
+			return err
+		}
+	}
+
 	for _, mount := range ReservedMounts {
 		err := exec.Command("umount", c.root+mount).Run()
 		if err != nil {
@@ -6,25 +6,107 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 )
 
-// generateGrubRecipe generates a new grub recipe with the given details
-// kernel version is automatically detected
-func generateGrubRecipe(rootPath string, rootUuid string, entryName string) error {
-	PrintVerbose("generateGrubConfig: generating grub config")
+// GrubRegion is a named, user-editable segment of the generated GRUB
+// recipe, delimited by "# ABROOT-<Name>-START" / "# ABROOT-<Name>-END"
+// markers. Default is used when no prior recipe exists to carry the
+// user's customization forward from
+type GrubRegion struct {
+	Name    string
+	Default string
+}
 
-	recipePath := filepath.Join(rootPath, "etc", "grub.d", "10_abroot")
-	// following template is based on vanilla os 2.0, needs to be updated
-	// to support other distros (and remove what's not needed)
-	template := `#!/bin/sh
+// grubRegions are the segments of 10_abroot a user may customize by
+// hand; they survive being overwritten by generateGrubRecipe
+var grubRegions = []GrubRegion{
+	{Name: "CONSOLE", Default: "set menu_color_normal=white/black\nset menu_color_highlight=black/light-gray"},
+	{Name: "CMDLINE", Default: `set abroot_cmdline="quiet splash bgrt_disable $vt_handoff"`},
+}
+
+// liveGrubRecipePath is the 10_abroot recipe on the presently booted
+// root, i.e. wherever ABRoot itself is running from. generateGrubRecipe
+// renders into the future root's freshly extracted rootPath instead,
+// which only ever contains whatever 10_abroot shipped in the image, so
+// MergeGrubRegions must read the user's hand-edited CONSOLE/CMDLINE
+// regions from here rather than from that fresh copy
+const liveGrubRecipePath = "/etc/grub.d/10_abroot"
+
+// regionMarkers returns the start/end marker lines delimiting the named
+// GrubRegion
+func regionMarkers(name string) (start, end string) {
+	return "# ABROOT-" + name + "-START", "# ABROOT-" + name + "-END"
+}
+
+// fillRegionDefaults fills each region's empty marker pair in content
+// with region.Default, so a freshly generated recipe (or one whose
+// region MergeGrubRegions found nothing to carry forward for) still
+// renders with sensible defaults
+func fillRegionDefaults(content string, regions []GrubRegion) string {
+	for _, region := range regions {
+		start, end := regionMarkers(region.Name)
+
+		pattern := regexp.MustCompile(regexp.QuoteMeta(start) + `\n` + regexp.QuoteMeta(end))
+		content = pattern.ReplaceAllLiteralString(content, start+"\n"+region.Default+"\n"+end)
+	}
+
+	return content
+}
+
+// MergeGrubRegions splices the user's existing content for each region,
+// as captured from oldPath, into newContent, leaving newContent's
+// rendering (normally each region's Default, filled in by
+// fillRegionDefaults) untouched wherever oldPath doesn't exist yet or
+// has nothing recorded for that region
+func MergeGrubRegions(oldPath string, newContent string, regions []GrubRegion) string {
+	existing, err := ioutil.ReadFile(oldPath)
+	if err != nil {
+		return newContent
+	}
+
+	for _, region := range regions {
+		start, end := regionMarkers(region.Name)
+
+		captured := extractBetween(string(existing), start, end)
+		if captured == "" {
+			continue
+		}
+
+		pattern := regexp.MustCompile(regexp.QuoteMeta(start) + `[\s\S]*?` + regexp.QuoteMeta(end))
+		// captured is spliced in literally: ReplaceAllString would treat a
+		// "$vt_handoff"-style token inside it as a submatch reference and
+		// silently drop it
+		newContent = pattern.ReplaceAllLiteralString(newContent, start+"\n"+captured+"\n"+end)
+	}
+
+	return newContent
+}
+
+// extractBetween returns the trimmed content found between a start and
+// end marker line, or "" if the markers aren't present in content
+func extractBetween(content string, start string, end string) string {
+	pattern := regexp.MustCompile(regexp.QuoteMeta(start) + `\n([\s\S]*?)\n` + regexp.QuoteMeta(end))
+	m := pattern.FindStringSubmatch(content)
+	if m == nil {
+		return ""
+	}
+
+	return strings.TrimSpace(m[1])
+}
+
+// grubPreamble holds the gfxmode helper and the user-editable console
+// and cmdline regions shared by both A and B entries
+const grubPreamble = `#!/bin/sh
 # ABRoot GRUB configuration file
 # This file is automatically generated by ABRoot
 # Do not edit this file manually
 
 exec tail -n +3 $0
 
-set menu_color_normal=white/black
-set menu_color_highlight=black/light-gray
+# ABROOT-CONSOLE-START
+# ABROOT-CONSOLE-END
 
 function gfxmode {
 	set gfxpayload="${1}"
@@ -55,7 +137,40 @@ set linux_gfx_mode=text
 fi
 export linux_gfx_mode
 
-menuentry '%s' --class gnu-linux --class gnu --class os {
+# pick the highest-priority root that still has tries_left, so default
+# always names a menuentry that actually exists below: a root whose
+# tries_left reached 0 has no menuentry at all (see grubEntryTemplate),
+# and relying on GRUB's "missing default" fallback instead of picking the
+# other root explicitly would make auto-rollback non-deterministic
+if [ -z "${abroot_a_priority}" ]; then set abroot_a_priority=10; fi
+if [ -z "${abroot_b_priority}" ]; then set abroot_b_priority=5; fi
+if [ -z "${abroot_a_tries_left}" ]; then set abroot_a_tries_left=3; fi
+if [ -z "${abroot_b_tries_left}" ]; then set abroot_b_tries_left=3; fi
+if [ "${abroot_a_tries_left}" = "0" ]; then
+	set default="abroot_b"
+elif [ "${abroot_b_tries_left}" = "0" ]; then
+	set default="abroot_a"
+elif [ "${abroot_a_priority}" -ge "${abroot_b_priority}" ]; then
+	set default="abroot_a"
+else
+	set default="abroot_b"
+fi
+
+# ABROOT-CMDLINE-START
+# ABROOT-CMDLINE-END
+`
+
+// grubEntryTemplate is rendered once per root (A/B) and wrapped in
+// ABROOT-ENTRY-<ROOT>-START/END markers, so that regenerating one root's
+// entry never clobbers the other root's, letting GRUB chain-boot
+// whichever of the two still has tries_left and the higher priority
+const grubEntryTemplate = `# ABROOT-ENTRY-%[1]s-START
+if [ "${abroot_%[2]s_tries_left}" != "0" ]; then
+menuentry '%[3]s' --id "abroot_%[2]s" --class gnu-linux --class gnu --class os {
+	if [ "${abroot_%[2]s_tries_left}" != "" ]; then
+		set abroot_%[2]s_tries_left=$((${abroot_%[2]s_tries_left} - 1))
+		save_env abroot_%[2]s_tries_left
+	fi
 	recordfail
 	load_video
 	gfxmode $linux_gfx_mode
@@ -63,9 +178,29 @@ menuentry '%s' --class gnu-linux --class gnu --class os {
 	if [ x$grub_platform = xxen ]; then insmod xzio; insmod lzopio; fi
 	insmod part_gpt
 	insmod ext2
-	search --no-floppy --fs-uuid --set=root %s
-	linux   /.system/boot/vmlinuz-%s root=UUID=%s quiet splash bgrt_disable $vt_handoff
-	initrd  /.system/boot/initrd.img-%s`
+	search --no-floppy --fs-uuid --set=root %[4]s
+	linux   /.system/boot/vmlinuz-%[5]s root=UUID=%[4]s $abroot_cmdline
+	initrd  /.system/boot/initrd.img-%[5]s
+}
+fi
+# ABROOT-ENTRY-%[1]s-END`
+
+// entryMarkers returns the start/end marker lines used to delimit the
+// menuentry generated for the given root ("a" or "b")
+func entryMarkers(root string) (start, end string) {
+	upper := strings.ToUpper(root)
+	return fmt.Sprintf("# ABROOT-ENTRY-%s-START", upper),
+		fmt.Sprintf("# ABROOT-ENTRY-%s-END", upper)
+}
+
+// generateGrubRecipe (re)generates the menuentry for the given root
+// ("a" or "b") inside /etc/grub.d/10_abroot, preserving whatever entry
+// already exists for the other root so the GRUB priority/tries_left
+// chain keeps working across upgrades. Kernel version is auto-detected.
+func generateGrubRecipe(rootPath string, rootUuid string, entryName string, root string) error {
+	PrintVerbose("generateGrubConfig: generating grub config")
+
+	recipePath := filepath.Join(rootPath, "etc", "grub.d", "10_abroot")
 
 	kernelVersion := getKernelVersion(rootPath)
 	if kernelVersion == "" {
@@ -81,11 +216,37 @@ menuentry '%s' --class gnu-linux --class gnu --class os {
 		return err
 	}
 
-	err = ioutil.WriteFile(
-		recipePath,
-		[]byte(fmt.Sprintf(template, entryName, rootUuid, kernelVersion, rootUuid, kernelVersion)),
-		0644,
+	newEntry := fmt.Sprintf(
+		grubEntryTemplate,
+		strings.ToUpper(root),
+		strings.ToLower(root),
+		entryName,
+		rootUuid,
+		kernelVersion,
 	)
+
+	// the other root's entry lives in the presently booted root's recipe,
+	// not in rootPath's freshly extracted copy (see liveGrubRecipePath)
+	otherStart, otherEnd := entryMarkers(otherRoot(root))
+	otherEntry := ""
+	if existing, err := ioutil.ReadFile(liveGrubRecipePath); err == nil {
+		otherEntry = extractRegion(string(existing), otherStart, otherEnd)
+	}
+
+	var content strings.Builder
+	content.WriteString(grubPreamble)
+	content.WriteString("\n")
+	content.WriteString(newEntry)
+	content.WriteString("\n")
+	if otherEntry != "" {
+		content.WriteString(otherEntry)
+		content.WriteString("\n")
+	}
+
+	withDefaults := fillRegionDefaults(content.String(), grubRegions)
+	merged := MergeGrubRegions(liveGrubRecipePath, withDefaults, grubRegions)
+
+	err = ioutil.WriteFile(recipePath, []byte(merged), 0644)
 	if err != nil {
 		PrintVerbose("generateGrubConfig:err(3): %s", err)
 		return err
@@ -94,6 +255,14 @@ menuentry '%s' --class gnu-linux --class gnu --class os {
 	return nil
 }
 
+// extractRegion returns the full marker block (including the markers
+// themselves) between start and end as found in content, or "" if not
+// found
+func extractRegion(content string, start string, end string) string {
+	pattern := regexp.MustCompile(regexp.QuoteMeta(start) + `[\s\S]*?` + regexp.QuoteMeta(end))
+	return pattern.FindString(content)
+}
+
 // getKernelVersion returns the latest kernel version available in the root
 func getKernelVersion(rootPath string) string {
 	PrintVerbose("getKernelVersion: getting kernel version")
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"os"
+	"testing"
+)
+
+func TestExtractBetween(t *testing.T) {
+	content := "before\n# START\nuser content\nmore content\n# END\nafter"
+
+	got := extractBetween(content, "# START", "# END")
+	want := "user content\nmore content"
+	if got != want {
+		t.Errorf("extractBetween() = %q, want %q", got, want)
+	}
+}
+
+func TestExtractBetweenNoMarkers(t *testing.T) {
+	got := extractBetween("nothing to see here", "# START", "# END")
+	if got != "" {
+		t.Errorf("extractBetween() = %q, want empty string", got)
+	}
+}
+
+func TestFillRegionDefaults(t *testing.T) {
+	regions := []GrubRegion{
+		{Name: "CMDLINE", Default: "quiet splash"},
+	}
+	content := "# ABROOT-CMDLINE-START\n# ABROOT-CMDLINE-END"
+
+	got := fillRegionDefaults(content, regions)
+	want := "# ABROOT-CMDLINE-START\nquiet splash\n# ABROOT-CMDLINE-END"
+	if got != want {
+		t.Errorf("fillRegionDefaults() = %q, want %q", got, want)
+	}
+}
+
+func TestMergeGrubRegionsCarriesForwardExistingContent(t *testing.T) {
+	regions := []GrubRegion{
+		{Name: "CMDLINE", Default: "quiet splash"},
+	}
+
+	oldPath := t.TempDir() + "/10_abroot"
+	oldContent := "# ABROOT-CMDLINE-START\nquiet splash mitigations=off\n# ABROOT-CMDLINE-END"
+	if err := os.WriteFile(oldPath, []byte(oldContent), 0644); err != nil {
+		t.Fatalf("failed to write fixture: %s", err)
+	}
+
+	newContent := "# ABROOT-CMDLINE-START\nquiet splash\n# ABROOT-CMDLINE-END"
+
+	got := MergeGrubRegions(oldPath, newContent, regions)
+	want := "# ABROOT-CMDLINE-START\nquiet splash mitigations=off\n# ABROOT-CMDLINE-END"
+	if got != want {
+		t.Errorf("MergeGrubRegions() = %q, want %q", got, want)
+	}
+}
+
+func TestMergeGrubRegionsKeepsDefaultsWhenOldPathMissing(t *testing.T) {
+	regions := []GrubRegion{
+		{Name: "CMDLINE", Default: "quiet splash"},
+	}
+	newContent := "# ABROOT-CMDLINE-START\nquiet splash\n# ABROOT-CMDLINE-END"
+
+	got := MergeGrubRegions(t.TempDir()+"/does-not-exist", newContent, regions)
+	if got != newContent {
+		t.Errorf("MergeGrubRegions() = %q, want unchanged %q", got, newContent)
+	}
+}
@@ -0,0 +1,303 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2023
+	Description:
+		UpdateHistory persists the progress of each ABSystem.Upgrade
+		attempt to /var/lib/abroot/history, so a crash between stages
+		doesn't force a full re-pull and re-extract on the next run,
+		inspired by Fuchsia's system-updater history and Gentoo
+		catalyst's resume support.
+*/
+
+// historyDir is where each upgrade attempt's record is persisted
+const historyDir = "/var/lib/abroot/history"
+
+// HistoryRecordsToKeep is how many non-pending history records
+// ABSystem.Upgrade keeps around after a successful run, via PruneHistory
+const HistoryRecordsToKeep = 20
+
+// HistoryState is the lifecycle state of a single upgrade attempt
+type HistoryState string
+
+const (
+	HistoryPending    HistoryState = "pending"
+	HistorySucceeded  HistoryState = "succeeded"
+	HistoryFailed     HistoryState = "failed"
+	HistoryRolledBack HistoryState = "rolled_back"
+)
+
+// HistoryRecord is the on-disk representation of a single upgrade
+// attempt, stored at historyDir/<id>.json
+type HistoryRecord struct {
+	ID           string       `json:"id"`
+	StartedAt    time.Time    `json:"started_at"`
+	DigestFrom   string       `json:"digest_from"`
+	DigestTo     string       `json:"digest_to"`
+	Stage        string       `json:"stage"`
+	ArtifactPath string       `json:"artifact_path,omitempty"`
+	State        HistoryState `json:"state"`
+	Error        string       `json:"error,omitempty"`
+}
+
+// UpdateHistory tracks and persists a single in-progress upgrade
+// attempt
+type UpdateHistory struct {
+	record *HistoryRecord
+}
+
+// NewUpdateHistory creates and persists a new pending HistoryRecord for
+// an upgrade from digestFrom to digestTo (digestTo may be filled in
+// later via Checkpoint, once the target image has actually been
+// resolved)
+func NewUpdateHistory(digestFrom string, digestTo string) (*UpdateHistory, error) {
+	PrintVerbose("NewUpdateHistory: running...")
+
+	err := os.MkdirAll(historyDir, 0755)
+	if err != nil {
+		PrintVerbose("NewUpdateHistory:err: %s", err)
+		return nil, err
+	}
+
+	h := &UpdateHistory{
+		record: &HistoryRecord{
+			ID:         newHistoryID(),
+			StartedAt:  time.Now(),
+			DigestFrom: digestFrom,
+			DigestTo:   digestTo,
+			Stage:      "stage-0-update-checked",
+			State:      HistoryPending,
+		},
+	}
+
+	err = h.save()
+	if err != nil {
+		PrintVerbose("NewUpdateHistory:err(2): %s", err)
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// newHistoryID returns a lexically time-sortable record id
+func newHistoryID() string {
+	return fmt.Sprintf("%020d-%s", time.Now().UnixNano(), uuid.New().String()[:8])
+}
+
+// path returns the file this record is persisted to
+func (h *UpdateHistory) path() string {
+	return filepath.Join(historyDir, h.record.ID+".json")
+}
+
+// save writes the record to disk
+func (h *UpdateHistory) save() error {
+	bytes, err := json.MarshalIndent(h.record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(h.path(), bytes, 0644)
+}
+
+// historyStageOrder ranks every checkpoint name ABSystem.Upgrade emits,
+// so Resume can tell which stages of a prior, interrupted attempt are
+// already done and must not be repeated (most importantly, the
+// AtomicSwap in stage 6, which would silently revert an already-applied
+// upgrade if run twice)
+var historyStageOrder = map[string]int{
+	"stage-0-update-checked":        0,
+	"stage-1-future-mounted":        1,
+	"stage-4-rootfs-extracted":      4,
+	"stage-6-swapped":               6,
+	"stage-7-bootloader-updated":    7,
+	"stage-10a-state-promoted":      8,
+	"stage-10b-bootloader-promoted": 9,
+	"stage-10-promoted":             10,
+}
+
+// stageAtLeast reports whether h's last recorded checkpoint is at or
+// past stage, so callers can skip stages a previous attempt already
+// completed
+func stageAtLeast(h *UpdateHistory, stage string) bool {
+	return historyStageOrder[h.record.Stage] >= historyStageOrder[stage]
+}
+
+// Checkpoint records the stage an upgrade attempt just completed and
+// where its artifact landed, so a Resume knows what can be skipped.
+// ABSystem.Upgrade calls this after stages 1, 4, 6, 7 and 10 (the latter
+// in two steps); stages 2, 3 and 5 have no checkpoint of their own and
+// are skipped together with the checkpointed stage that follows them,
+// and stages 8 and 9 record none and run again on every Resume
+func (h *UpdateHistory) Checkpoint(stage string, artifactPath string) error {
+	PrintVerbose("UpdateHistory.Checkpoint: %s", stage)
+
+	h.record.Stage = stage
+	h.record.ArtifactPath = artifactPath
+
+	return h.save()
+}
+
+// SetDigestTo records the resolved target digest, once known, typically
+// right after the registry pull
+func (h *UpdateHistory) SetDigestTo(digest string) error {
+	h.record.DigestTo = digest
+	return h.save()
+}
+
+// Succeed marks the attempt as successfully completed
+func (h *UpdateHistory) Succeed() error {
+	PrintVerbose("UpdateHistory.Succeed: %s", h.record.ID)
+
+	h.record.State = HistorySucceeded
+	return h.save()
+}
+
+// Fail marks the attempt as failed, recording the error that stopped it
+func (h *UpdateHistory) Fail(cause error) error {
+	PrintVerbose("UpdateHistory.Fail: %s: %s", h.record.ID, cause)
+
+	h.record.State = HistoryFailed
+	h.record.Error = cause.Error()
+	return h.save()
+}
+
+// RolledBack marks the attempt as rolled back
+func (h *UpdateHistory) RolledBack() error {
+	h.record.State = HistoryRolledBack
+	return h.save()
+}
+
+// FindPendingHistory scans historyDir for the most recent record still
+// in the pending state, returning nil if every prior attempt completed
+// or failed cleanly
+func FindPendingHistory() (*UpdateHistory, error) {
+	PrintVerbose("FindPendingHistory: running...")
+
+	records, err := ListHistory()
+	if err != nil {
+		PrintVerbose("FindPendingHistory:err: %s", err)
+		return nil, err
+	}
+
+	for _, record := range records {
+		if record.State == HistoryPending {
+			return &UpdateHistory{record: record}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// ListHistory returns every upgrade attempt record, most recent first
+func ListHistory() ([]*HistoryRecord, error) {
+	PrintVerbose("ListHistory: running...")
+
+	entries, err := os.ReadDir(historyDir)
+	if os.IsNotExist(err) {
+		return []*HistoryRecord{}, nil
+	}
+	if err != nil {
+		PrintVerbose("ListHistory:err: %s", err)
+		return nil, err
+	}
+
+	var records []*HistoryRecord
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		bytes, err := os.ReadFile(filepath.Join(historyDir, entry.Name()))
+		if err != nil {
+			PrintVerbose("ListHistory:err(2): %s", err)
+			return nil, err
+		}
+
+		var record HistoryRecord
+		err = json.Unmarshal(bytes, &record)
+		if err != nil {
+			PrintVerbose("ListHistory:err(3): %s", err)
+			return nil, err
+		}
+
+		records = append(records, &record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID > records[j].ID
+	})
+
+	return records, nil
+}
+
+// ShowHistory returns the record with the given id
+func ShowHistory(id string) (*HistoryRecord, error) {
+	PrintVerbose("ShowHistory: %s", id)
+
+	bytes, err := os.ReadFile(filepath.Join(historyDir, id+".json"))
+	if err != nil {
+		PrintVerbose("ShowHistory:err: %s", err)
+		return nil, err
+	}
+
+	var record HistoryRecord
+	err = json.Unmarshal(bytes, &record)
+	if err != nil {
+		PrintVerbose("ShowHistory:err(2): %s", err)
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// PruneHistory removes every non-pending record beyond the keep most
+// recent ones, so historyDir doesn't grow without bound
+func PruneHistory(keep int) error {
+	PrintVerbose("PruneHistory: keeping %d records", keep)
+
+	records, err := ListHistory()
+	if err != nil {
+		PrintVerbose("PruneHistory:err: %s", err)
+		return err
+	}
+
+	kept := 0
+	for _, record := range records {
+		if record.State == HistoryPending {
+			continue
+		}
+
+		kept++
+		if kept <= keep {
+			continue
+		}
+
+		err := os.Remove(filepath.Join(historyDir, record.ID+".json"))
+		if err != nil {
+			PrintVerbose("PruneHistory:err(2): %s", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// errUpgradeInProgress is returned by ABSystem.Upgrade when a previous
+// attempt is still pending and must be resumed first; PruneHistory never
+// removes a pending record
+var errUpgradeInProgress = errors.New("a previous upgrade did not complete, run ABSystem.Resume() first")
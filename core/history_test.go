@@ -0,0 +1,24 @@
+package core
+
+import "testing"
+
+func TestStageAtLeast(t *testing.T) {
+	tests := []struct {
+		recorded string
+		stage    string
+		want     bool
+	}{
+		{"stage-6-swapped", "stage-4-rootfs-extracted", true},
+		{"stage-6-swapped", "stage-6-swapped", true},
+		{"stage-4-rootfs-extracted", "stage-6-swapped", false},
+		{"stage-10-promoted", "stage-7-bootloader-updated", true},
+		{"stage-0-update-checked", "stage-1-future-mounted", false},
+	}
+
+	for _, tt := range tests {
+		h := &UpdateHistory{record: &HistoryRecord{Stage: tt.recorded}}
+		if got := stageAtLeast(h, tt.stage); got != tt.want {
+			t.Errorf("stageAtLeast(recorded=%q, stage=%q) = %v, want %v", tt.recorded, tt.stage, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2023
+	Description:
+		Signer wraps the sbsigntool invocation used to sign and verify
+		Unified Kernel Images for Secure Boot, using the key pair
+		declared in settings.Cnf.SecureBoot.
+*/
+
+// Signer signs and verifies UKIs for Secure Boot using sbsigntool
+// against the key pair declared in settings.Cnf.SecureBoot
+type Signer struct {
+	KeyPath   string
+	CertPath  string
+	PKCS11Uri string
+}
+
+// NewSigner builds a Signer from settings.Cnf.SecureBoot
+func NewSigner() *Signer {
+	return &Signer{
+		KeyPath:   settings.Cnf.SecureBoot.DbKey,
+		CertPath:  settings.Cnf.SecureBoot.DbCert,
+		PKCS11Uri: settings.Cnf.SecureBoot.Pkcs11Uri,
+	}
+}
+
+// Sign signs src with sbsign and writes the signed UKI to dst
+func (sg *Signer) Sign(src string, dst string) error {
+	PrintVerbose("Signer.Sign: signing %s", src)
+
+	key := sg.KeyPath
+	if sg.PKCS11Uri != "" {
+		// a PKCS#11 URI already carries the "pkcs11:" scheme (RFC 7512);
+		// prepending it again would hand sbsign an unparsable key
+		key = sg.PKCS11Uri
+		if !strings.HasPrefix(key, "pkcs11:") {
+			key = "pkcs11:" + key
+		}
+	}
+
+	err := exec.Command(
+		"sbsign",
+		"--key", key,
+		"--cert", sg.CertPath,
+		"--output", dst,
+		src,
+	).Run()
+	if err != nil {
+		PrintVerbose("Signer.Sign:err: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// Verify checks that path carries a valid Secure Boot signature for
+// sg's certificate
+func (sg *Signer) Verify(path string) error {
+	PrintVerbose("Signer.Verify: verifying %s", path)
+
+	err := exec.Command("sbverify", "--cert", sg.CertPath, path).Run()
+	if err != nil {
+		PrintVerbose("Signer.Verify:err: %s", err)
+		return errors.New("secure boot signature verification failed for " + path)
+	}
+
+	return nil
+}
+
+// sha256Of returns the hex sha256 digest of path, used to record a
+// UKI's checksum and to name its generation root
+func sha256Of(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
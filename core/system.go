@@ -27,6 +27,10 @@ type ABSystem struct {
 	RootM    *ABRootManager
 	Registry *Registry
 	CurImage *ABImage
+
+	// PendingUpgrade is set by NewABSystem when a previous Upgrade
+	// attempt did not reach a terminal state, nil otherwise
+	PendingUpgrade *UpdateHistory
 }
 
 type QueuedFunction struct {
@@ -50,11 +54,18 @@ func NewABSystem() (*ABSystem, error) {
 	r := NewRegistry()
 	rm := NewABRootManager()
 
+	pending, err := FindPendingHistory()
+	if err != nil {
+		PrintVerbose("NewABSystem:error(2): %s", err)
+		return nil, err
+	}
+
 	return &ABSystem{
-		Checks:   c,
-		RootM:    rm,
-		Registry: r,
-		CurImage: i,
+		Checks:         c,
+		RootM:          rm,
+		Registry:       r,
+		CurImage:       i,
+		PendingUpgrade: pending,
 	}, nil
 }
 
@@ -151,6 +162,29 @@ func (s *ABSystem) ResetQueue() {
 
 // Upgrade upgrades the system to the latest available image
 func (s *ABSystem) Upgrade() error {
+	if s.PendingUpgrade != nil {
+		PrintVerbose("ABSystem.Upgrade:error(0): %s", errUpgradeInProgress)
+		return errUpgradeInProgress
+	}
+
+	return s.runUpgrade(nil)
+}
+
+// Resume replays an interrupted upgrade attempt, skipping whatever
+// stages its history record shows were already completed, instead of
+// re-pulling and re-extracting the image from scratch
+func (s *ABSystem) Resume() error {
+	if s.PendingUpgrade == nil {
+		return errors.New("no pending upgrade to resume")
+	}
+
+	return s.runUpgrade(s.PendingUpgrade)
+}
+
+// runUpgrade performs the actual upgrade pipeline. When resumeFrom is
+// nil a brand new attempt is recorded; otherwise stages already marked
+// as completed in resumeFrom are skipped
+func (s *ABSystem) runUpgrade(resumeFrom *UpdateHistory) (err error) {
 	PrintVerbose("ABSystem.Upgrade: starting upgrade")
 
 	s.ResetQueue()
@@ -177,6 +211,28 @@ func (s *ABSystem) Upgrade() error {
 		return err
 	}
 
+	history := resumeFrom
+	if history == nil {
+		history, err = NewUpdateHistory(s.CurImage.Digest, "")
+		if err != nil {
+			PrintVerbose("ABSystemUpgrade:error(1.1): %s", err)
+			return err
+		}
+	}
+	s.PendingUpgrade = history
+
+	defer func() {
+		if err != nil {
+			_ = history.Fail(err)
+		} else {
+			_ = history.Succeed()
+			if pruneErr := PruneHistory(HistoryRecordsToKeep); pruneErr != nil {
+				PrintVerbose("ABSystem.Upgrade: failed to prune old history records: %s", pruneErr)
+			}
+		}
+		s.PendingUpgrade = nil
+	}()
+
 	// Stage 1: Get the future root and boot partitions
 	// 			and mount future to /part-future
 	PrintVerbose("[Stage 1] ABSystemUpgrade")
@@ -193,167 +249,478 @@ func (s *ABSystem) Upgrade() error {
 		return err
 	}
 
-	err = partFuture.Partition.Mount("/part-future/")
+	// the mount itself is always (re)run, tolerating "already mounted":
+	// unlike the history record, it does not survive a reboot, so a
+	// Resume() after a reboot still needs it even though stage 1 was
+	// already checkpointed by the interrupted attempt
+	if !isMounted("/part-future/") {
+		err = partFuture.Partition.Mount("/part-future/")
+		if err != nil {
+			PrintVerbose("ABSystem.Upgrade:error(4): %s", err)
+			return err
+		}
+	}
+
+	err = history.Checkpoint("stage-1-future-mounted", "")
 	if err != nil {
-		PrintVerbose("ABSystem.Upgrade:error(4): %s", err)
+		PrintVerbose("ABSystem.Upgrade:error(4.1): %s", err)
 		return err
 	}
 
 	s.AddToCleanUpQueue("umountFuture", partFuture)
 
-	// Stage 2: Pull the new image
-	PrintVerbose("[Stage 2] ABSystemUpgrade")
-
-	podman := NewPodman()
 	fullImageName := settings.Cnf.Registry + "/" + settings.Cnf.Name + ":" + settings.Cnf.Tag
-	podmanImage, err := podman.Pull(fullImageName)
+	digestTo := history.record.DigestTo
+
+	if stageAtLeast(history, "stage-4-rootfs-extracted") {
+		// the rootfs was already pulled and extracted by a previous,
+		// interrupted attempt: skip straight to Stage 5
+		PrintVerbose("ABSystem.Upgrade: resuming from stage-4-rootfs-extracted, skipping pull and extraction")
+	} else {
+		// Stage 2: Pull the new image
+		PrintVerbose("[Stage 2] ABSystemUpgrade")
+
+		podman := NewPodman()
+		podmanImage, err := podman.Pull(fullImageName)
+		if err != nil {
+			PrintVerbose("ABSystem.Upgrade:error(5): %s", err)
+			return err
+		}
+
+		digestTo = podmanImage.Digest
+		err = history.SetDigestTo(digestTo)
+		if err != nil {
+			PrintVerbose("ABSystem.Upgrade:error(5.1): %s", err)
+			return err
+		}
+
+		// Stage 3: Make a Containerfile with user packages
+		PrintVerbose("[Stage 3] ABSystemUpgrade")
+
+		pkgM := NewPackageManager()
+		pkgsFinal := pkgM.GetFinalCmd()
+
+		labels := map[string]string{
+			"maintainer": "'Generated by ABRoot'",
+		}
+		args := map[string]string{}
+		if pkgsFinal == "" {
+			pkgsFinal = "true"
+		}
+		content := `RUN ` + pkgsFinal
+
+		containerFile := podman.NewContainerFile(
+			fullImageName,
+			labels,
+			args,
+			content,
+		)
+
+		// Stage 4: Extract the rootfs
+		PrintVerbose("[Stage 4] ABSystemUpgrade")
+
+		err = podman.GenerateRootfs(
+			fullImageName,
+			containerFile,
+			partFuture.Partition.MountPoint,
+			partFuture.Partition.MountPoint+"/.system.new/",
+		)
+		if err != nil {
+			PrintVerbose("ABSystem.Upgrade:error(6): %s", err)
+			return err
+		}
+
+		err = history.Checkpoint("stage-4-rootfs-extracted", partFuture.Partition.MountPoint+"/.system.new")
+		if err != nil {
+			PrintVerbose("ABSystem.Upgrade:error(6.1): %s", err)
+			return err
+		}
+	}
+
+	if !stageAtLeast(history, "stage-6-swapped") {
+		// Stage 5: Write abimage.abr.new to future/
+		PrintVerbose("[Stage 5] ABSystemUpgrade")
+
+		abimage := NewABImage(
+			digestTo,
+			fullImageName,
+		)
+		err = abimage.WriteTo(partFuture.Partition.MountPoint, "new")
+		if err != nil {
+			PrintVerbose("ABSystem.Upgrade:error(7): %s", err)
+			return err
+		}
+
+		// Stage 6: Atomic swap the rootfs and abimage.abr
+		PrintVerbose("[Stage 6] ABSystemUpgrade")
+
+		err = AtomicSwap(
+			partFuture.Partition.MountPoint+"/.system/",
+			partFuture.Partition.MountPoint+"/.system.new/",
+		)
+		if err != nil {
+			PrintVerbose("ABSystem.Upgrade:error(8): %s", err)
+			return err
+		}
+
+		oldABImage := partFuture.Partition.MountPoint + "/abimage.abr"
+		newABImage := partFuture.Partition.MountPoint + "/abimage-new.abr"
+		err = AtomicSwap(oldABImage, newABImage)
+		if err != nil {
+			PrintVerbose("ABSystem.Upgrade:error(9): %s", err)
+			return err
+		}
+
+		err = history.Checkpoint("stage-6-swapped", partFuture.Partition.MountPoint+"/.system")
+		if err != nil {
+			PrintVerbose("ABSystem.Upgrade:error(9.1): %s", err)
+			return err
+		}
+	} else {
+		// the rootfs and abimage.abr were already swapped by a previous,
+		// interrupted attempt: redoing AtomicSwap here would exchange
+		// them right back, reverting a finished upgrade
+		PrintVerbose("ABSystem.Upgrade: resuming from stage-6-swapped, skipping rootfs swap")
+	}
+
+	bootloader := NewBootloader()
+
+	if !stageAtLeast(history, "stage-7-bootloader-updated") {
+		// Stage 7: Update the bootloader
+		PrintVerbose("[Stage 7] ABSystemUpgrade")
+
+		ukiDigest, err := bootloader.GenerateEntry(
+			partFuture.Partition.MountPoint+"/.system/",
+			partFuture.Partition.Uuid,
+			partFuture.IdentifiedAs,
+			partFuture.IdentifiedAs,
+		)
+		if err != nil {
+			PrintVerbose("ABSystem.Upgrade:error(10): %s", err)
+			return err
+		}
+
+		if ukiDigest != "" {
+			err = recordUKIDigest(partFuture.Partition.MountPoint, ukiDigest)
+			if err != nil {
+				PrintVerbose("ABSystem.Upgrade:error(10.2): %s", err)
+				return err
+			}
+		}
+
+		chroot, err := NewChroot(
+			partFuture.Partition.MountPoint+"/.system/",
+			partFuture.Partition.Uuid,
+			partFuture.Partition.Device,
+		)
+		if err != nil {
+			PrintVerbose("ABSystem.Upgrade:error(10.1): %s", err)
+			return err
+		}
+
+		s.AddToCleanUpQueue("closeChroot", chroot)
+
+		err = bootloader.InstallFromChroot(chroot)
+		if err != nil {
+			PrintVerbose("ABSystem.Upgrade:error(11): %s", err)
+			return err
+		}
+
+		err = history.Checkpoint("stage-7-bootloader-updated", "")
+		if err != nil {
+			PrintVerbose("ABSystem.Upgrade:error(11.1): %s", err)
+			return err
+		}
+	} else {
+		// the bootloader entry was already generated and installed by a
+		// previous, interrupted attempt: skip straight to Stage 8
+		PrintVerbose("ABSystem.Upgrade: resuming from stage-7-bootloader-updated, skipping bootloader update")
+	}
+
+	// Stage 8: Sync /etc
+	PrintVerbose("[Stage 8] ABSystemUpgrade")
+
+	err = s.SyncEtc(partFuture.Partition.MountPoint + "/.system/etc/")
 	if err != nil {
-		PrintVerbose("ABSystem.Upgrade:error(5): %s", err)
+		PrintVerbose("ABSystem.Upgrade:error(12): %s", err)
 		return err
 	}
 
-	// Stage 3: Make a Containerfile with user packages
-	PrintVerbose("[Stage 3] ABSystemUpgrade")
+	// Stage 9: Mount boot partition
+	PrintVerbose("[Stage 9] ABSystemUpgrade")
 
-	pkgM := NewPackageManager()
-	pkgsFinal := pkgM.GetFinalCmd()
+	uuid := uuid.New().String()
+	err = os.Mkdir("/tmp/"+uuid, 0755)
+	if err != nil {
+		PrintVerbose("ABSystem.Upgrade:error(13): %s", err)
+		return err
+	}
 
-	labels := map[string]string{
-		"maintainer": "'Generated by ABRoot'",
+	err = partBoot.Mount("/tmp/" + uuid)
+	if err != nil {
+		PrintVerbose("ABSystem.Upgrade:error(14): %s", err)
+		return err
 	}
-	args := map[string]string{}
-	if pkgsFinal == "" {
-		pkgsFinal = "true"
+
+	bootMount := "/tmp/" + uuid
+
+	if !stageAtLeast(history, "stage-10-promoted") {
+		// Stage 10: Atomic swap the boot state and the bootloader. Each of
+		// the two swaps below is atomic on its own, not the pair: a crash
+		// between them leaves the new boot state promoted and the
+		// bootloader not, until Resume performs the remaining swap. Each
+		// swap is checkpointed right after it happens, not just once at
+		// the very end, so Resume never redoes a swap that already
+		// landed, which would silently revert it
+		PrintVerbose("[Stage 10] ABSystemUpgrade")
+
+		var bootState *BootState
+
+		if !stageAtLeast(history, "stage-10a-state-promoted") {
+			bootState, err = NewBootState(bootMount)
+			if err != nil {
+				PrintVerbose("ABSystem.Upgrade:error(15): %s", err)
+				return err
+			}
+
+			futureEntry, err := bootState.entryFor(partFuture.IdentifiedAs)
+			if err != nil {
+				PrintVerbose("ABSystem.Upgrade:error(15.1): %s", err)
+				return err
+			}
+
+			presentEntry, err := bootState.entryFor(otherRoot(partFuture.IdentifiedAs))
+			if err != nil {
+				PrintVerbose("ABSystem.Upgrade:error(15.2): %s", err)
+				return err
+			}
+
+			futureEntry.TriesLeft = defaultTriesLeft
+			futureEntry.Successful = false
+			futureEntry.Priority = presentEntry.Priority + 1
+			futureEntry.PreviousRoot = otherRoot(partFuture.IdentifiedAs)
+
+			err = bootState.WriteTo(bootMount, "new")
+			if err != nil {
+				PrintVerbose("ABSystem.Upgrade:error(15.3): %s", err)
+				return err
+			}
+
+			// promoteStagedFile renames the staged state into place on a
+			// first upgrade, when abroot-state.json doesn't exist yet, and
+			// AtomicSwaps it in otherwise; AtomicSwap alone would fail here
+			// since it requires both sides of the exchange to already exist
+			err = promoteStagedFile(
+				bootMount+"/abroot-state-new.json",
+				bootMount+"/abroot-state.json",
+			)
+			if err != nil {
+				PrintVerbose("ABSystem.Upgrade:error(15.4): %s", err)
+				return err
+			}
+
+			err = history.Checkpoint("stage-10a-state-promoted", bootMount)
+			if err != nil {
+				PrintVerbose("ABSystem.Upgrade:error(15.5): %s", err)
+				return err
+			}
+		} else {
+			// abroot-state.json was already promoted by a previous,
+			// interrupted attempt: reload the now-current state instead of
+			// recomputing and re-promoting it, which would bump priorities
+			// a second time
+			PrintVerbose("ABSystem.Upgrade: resuming from stage-10a-state-promoted, skipping state promotion")
+
+			bootState, err = NewBootState(bootMount)
+			if err != nil {
+				PrintVerbose("ABSystem.Upgrade:error(15.6): %s", err)
+				return err
+			}
+		}
+
+		if !stageAtLeast(history, "stage-10b-bootloader-promoted") {
+			err = bootloader.AtomicPromote(bootMount)
+			if err != nil {
+				PrintVerbose("ABSystem.Upgrade:error(16): %s", err)
+				return err
+			}
+
+			err = history.Checkpoint("stage-10b-bootloader-promoted", bootMount)
+			if err != nil {
+				PrintVerbose("ABSystem.Upgrade:error(16.1): %s", err)
+				return err
+			}
+		} else {
+			// the bootloader entry was already promoted by a previous,
+			// interrupted attempt: redoing AtomicPromote here would swap it
+			// right back, reverting a finished upgrade
+			PrintVerbose("ABSystem.Upgrade: resuming from stage-10b-bootloader-promoted, skipping bootloader promotion")
+		}
+
+		err = bootState.WriteGrubEnv(bootMount + "/grubenv")
+		if err != nil {
+			PrintVerbose("ABSystem.Upgrade:error(17): %s", err)
+			return err
+		}
+
+		err = history.Checkpoint("stage-10-promoted", bootMount)
+		if err != nil {
+			PrintVerbose("ABSystem.Upgrade:error(17.1): %s", err)
+			return err
+		}
+	} else {
+		// the bootloader and boot state were already promoted by a
+		// previous, interrupted attempt: nothing left to do for Stage 10
+		PrintVerbose("ABSystem.Upgrade: resuming from stage-10-promoted, skipping promotion")
 	}
-	content := `RUN ` + pkgsFinal
 
-	containerFile := podman.NewContainerFile(
-		fullImageName,
-		labels,
-		args,
-		content,
-	)
+	PrintVerbose("ABSystem.Upgrade: upgrade completed")
+	return nil
+}
 
-	// Stage 4: Extract the rootfs
-	PrintVerbose("[Stage 4] ABSystemUpgrade")
+// MarkBootSuccessful marks the currently booted root as successful and
+// resets its try counter. It is meant to be called by a systemd unit
+// once the user session is confirmed to be up, so that a root which
+// merely "boots" but never reaches a usable session doesn't get
+// permanently promoted
+func (s *ABSystem) MarkBootSuccessful() error {
+	PrintVerbose("ABSystem.MarkBootSuccessful: running...")
 
-	err = podman.GenerateRootfs(
-		fullImageName,
-		containerFile,
-		partFuture.Partition.MountPoint,
-		partFuture.Partition.MountPoint+"/.system.new/",
-	)
+	partBoot, err := s.RootM.GetBoot()
 	if err != nil {
-		PrintVerbose("ABSystem.Upgrade:error(6): %s", err)
+		PrintVerbose("ABSystem.MarkBootSuccessful:error: %s", err)
 		return err
 	}
 
-	// Stage 5: Write abimage.abr.new to future/
-	PrintVerbose("[Stage 5] ABSystemUpgrade")
+	uuid := uuid.New().String()
+	bootMount := "/tmp/" + uuid
+	err = os.Mkdir(bootMount, 0755)
+	if err != nil {
+		PrintVerbose("ABSystem.MarkBootSuccessful:error(2): %s", err)
+		return err
+	}
 
-	abimage := NewABImage(
-		podmanImage.Digest,
-		fullImageName,
-	)
-	err = abimage.WriteTo(partFuture.Partition.MountPoint, "new")
+	err = partBoot.Mount(bootMount)
 	if err != nil {
-		PrintVerbose("ABSystem.Upgrade:error(7): %s", err)
+		PrintVerbose("ABSystem.MarkBootSuccessful:error(3): %s", err)
 		return err
 	}
+	defer partBoot.Unmount()
 
-	// Stage 6: Atomic swap the rootfs and abimage.abr
-	PrintVerbose("[Stage 6] ABSystemUpgrade")
+	bootState, err := NewBootState(bootMount)
+	if err != nil {
+		PrintVerbose("ABSystem.MarkBootSuccessful:error(4): %s", err)
+		return err
+	}
 
-	err = AtomicSwap(
-		partFuture.Partition.MountPoint+"/.system/",
-		partFuture.Partition.MountPoint+"/.system.new/",
-	)
+	present, err := s.RootM.GetPresent()
 	if err != nil {
-		PrintVerbose("ABSystem.Upgrade:error(8): %s", err)
+		PrintVerbose("ABSystem.MarkBootSuccessful:error(5): %s", err)
 		return err
 	}
 
-	oldABImage := partFuture.Partition.MountPoint + "/abimage.abr"
-	newABImage := partFuture.Partition.MountPoint + "/abimage-new.abr"
-	err = AtomicSwap(oldABImage, newABImage)
+	entry, err := bootState.entryFor(present.IdentifiedAs)
 	if err != nil {
-		PrintVerbose("ABSystem.Upgrade:error(9): %s", err)
+		PrintVerbose("ABSystem.MarkBootSuccessful:error(6): %s", err)
 		return err
 	}
 
-	// Stage 7: Update the bootloader
-	PrintVerbose("[Stage 7] ABSystemUpgrade")
+	entry.Successful = true
+	entry.TriesLeft = defaultTriesLeft
 
-	err = generateGrubRecipe(
-		partFuture.Partition.MountPoint+"/.system/",
-		partFuture.Partition.Uuid,
-		partFuture.IdentifiedAs,
-	)
+	err = bootState.WriteTo(bootMount, "")
 	if err != nil {
-		PrintVerbose("ABSystem.Upgrade:error(10): %s", err)
+		PrintVerbose("ABSystem.MarkBootSuccessful:error(7): %s", err)
 		return err
 	}
 
-	chroot, err := NewChroot(
-		partFuture.Partition.MountPoint+"/.system/",
-		partFuture.Partition.Uuid,
-		partFuture.Partition.Device,
-	)
+	err = bootState.WriteGrubEnv(bootMount + "/grubenv")
 	if err != nil {
-		PrintVerbose("ABSystem.Upgrade:error(10.1): %s", err)
+		PrintVerbose("ABSystem.MarkBootSuccessful:error(8): %s", err)
 		return err
 	}
 
-	s.AddToCleanUpQueue("closeChroot", chroot)
+	PrintVerbose("ABSystem.MarkBootSuccessful: boot marked as successful")
+	return nil
+}
+
+// Rollback swaps the GRUB priority of the two roots so the previously
+// working one boots next, without performing a full re-image. It is
+// meant to be used when a boot failed before MarkBootSuccessful could
+// run, or triggered manually by the user
+func (s *ABSystem) Rollback() error {
+	PrintVerbose("ABSystem.Rollback: running...")
 
-	err = chroot.ExecuteCmds(
-		[]string{
-			"grub-mkconfig -o /boot/grub/grub.cfg",
-			"exit",
-		},
-	)
+	partBoot, err := s.RootM.GetBoot()
 	if err != nil {
-		PrintVerbose("ABSystem.Upgrade:error(11): %s", err)
+		PrintVerbose("ABSystem.Rollback:error: %s", err)
 		return err
 	}
 
-	// Stage 8: Sync /etc
-	PrintVerbose("[Stage 8] ABSystemUpgrade")
+	uuid := uuid.New().String()
+	bootMount := "/tmp/" + uuid
+	err = os.Mkdir(bootMount, 0755)
+	if err != nil {
+		PrintVerbose("ABSystem.Rollback:error(2): %s", err)
+		return err
+	}
 
-	err = s.SyncEtc(partFuture.Partition.MountPoint + "/.system/etc/")
+	err = partBoot.Mount(bootMount)
 	if err != nil {
-		PrintVerbose("ABSystem.Upgrade:error(12): %s", err)
+		PrintVerbose("ABSystem.Rollback:error(3): %s", err)
 		return err
 	}
+	defer partBoot.Unmount()
 
-	// Stage 9: Mount boot partition
-	PrintVerbose("[Stage 9] ABSystemUpgrade")
+	bootState, err := NewBootState(bootMount)
+	if err != nil {
+		PrintVerbose("ABSystem.Rollback:error(4): %s", err)
+		return err
+	}
 
-	uuid := uuid.New().String()
-	err = os.Mkdir("/tmp/"+uuid, 0755)
+	bootState.A.Priority, bootState.B.Priority = bootState.B.Priority, bootState.A.Priority
+	bootState.A.TriesLeft = defaultTriesLeft
+	bootState.B.TriesLeft = defaultTriesLeft
+
+	err = bootState.WriteTo(bootMount, "")
 	if err != nil {
-		PrintVerbose("ABSystem.Upgrade:error(13): %s", err)
+		PrintVerbose("ABSystem.Rollback:error(5): %s", err)
 		return err
 	}
 
-	err = partBoot.Mount("/tmp/" + uuid)
+	err = bootState.WriteGrubEnv(bootMount + "/grubenv")
 	if err != nil {
-		PrintVerbose("ABSystem.Upgrade:error(14): %s", err)
+		PrintVerbose("ABSystem.Rollback:error(6): %s", err)
+		return err
+	}
+
+	err = markLastSucceededHistoryRolledBack()
+	if err != nil {
+		PrintVerbose("ABSystem.Rollback:error(7): %s", err)
 		return err
 	}
 
-	// Stage 10: Atomic swap the bootloader
-	PrintVerbose("[Stage 10] ABSystemUpgrade")
+	PrintVerbose("ABSystem.Rollback: rolled back successfully")
+	return nil
+}
 
-	err = AtomicSwap(
-		"/tmp/"+uuid+"/grub.cfg",
-		"/tmp/"+uuid+"/grub.cfg.future",
-	)
+// markLastSucceededHistoryRolledBack finds the most recent succeeded
+// upgrade record and marks it HistoryRolledBack, so `abroot history
+// list` reflects that a rollback undid it. It is a no-op when there is
+// no succeeded record to mark, e.g. on a freshly installed system
+func markLastSucceededHistoryRolledBack() error {
+	records, err := ListHistory()
 	if err != nil {
-		PrintVerbose("ABSystem.Upgrade:error(15): %s", err)
 		return err
 	}
 
-	PrintVerbose("ABSystem.Upgrade: upgrade completed")
+	for _, record := range records {
+		if record.State != HistorySucceeded {
+			continue
+		}
+
+		return (&UpdateHistory{record: record}).RolledBack()
+	}
+
 	return nil
 }
@@ -0,0 +1,332 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// ukiGenerationsToKeep is the number of signed UKI generations kept per
+// root on the ESP: the current one plus the previous one, so a rollback
+// never finds its UKI already garbage collected
+const ukiGenerationsToKeep = 2
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2023
+	Description:
+		SystemdBootUKI is a Bootloader backend for EFI-only setups that
+		prefer systemd-boot and Unified Kernel Images over GRUB, taking
+		inspiration from Lanzaboote's generation-based UKI layout.
+*/
+
+// SystemdBootUKI bundles the kernel, initrd, cmdline and os-release of
+// a root into a single UKI, signed when settings.Cnf.SecureBoot.Enabled,
+// and installs it, plus a matching loader entry, onto the ESP
+type SystemdBootUKI struct {
+	// staged maps a root identifier ("a" or "b") to the tempdir holding
+	// the UKI and loader entry built for it by GenerateEntry, until
+	// AtomicPromote moves them onto the ESP
+	staged map[string]string
+}
+
+// NewSystemdBootUKI returns a ready to use SystemdBootUKI backend
+func NewSystemdBootUKI() *SystemdBootUKI {
+	return &SystemdBootUKI{staged: map[string]string{}}
+}
+
+// espName returns the abroot-<root> stem used for the UKI and loader
+// entry of the given root on the ESP
+func espName(root string) string {
+	return "abroot-" + strings.ToLower(root)
+}
+
+// GenerateEntry builds the UKI for rootPath in a tempdir and writes a
+// matching loader entry next to it, both staged until AtomicPromote. It
+// returns the sha256 digest of the staged UKI, so callers can record it
+// alongside the rest of the image metadata
+func (s *SystemdBootUKI) GenerateEntry(rootPath string, rootUuid string, entryName string, root string) (string, error) {
+	PrintVerbose("SystemdBootUKI.GenerateEntry: running...")
+
+	kernelVersion := getKernelVersion(rootPath)
+	if kernelVersion == "" {
+		err := errors.New("could not get kernel version")
+		PrintVerbose("SystemdBootUKI.GenerateEntry:err: %s", err)
+		return "", err
+	}
+
+	stageDir, err := os.MkdirTemp("", "abroot-uki-"+root+"-")
+	if err != nil {
+		PrintVerbose("SystemdBootUKI.GenerateEntry:err(2): %s", err)
+		return "", err
+	}
+
+	cmdline := "root=UUID=" + rootUuid + " quiet splash"
+	cmdlinePath := filepath.Join(stageDir, "cmdline")
+	err = os.WriteFile(cmdlinePath, []byte(cmdline), 0644)
+	if err != nil {
+		PrintVerbose("SystemdBootUKI.GenerateEntry:err(3): %s", err)
+		return "", err
+	}
+
+	unsignedPath := filepath.Join(stageDir, espName(root)+".unsigned.efi")
+	err = exec.Command(
+		"ukify", "build",
+		"--linux", filepath.Join(rootPath, "boot", "vmlinuz-"+kernelVersion),
+		"--initrd", filepath.Join(rootPath, "boot", "initrd.img-"+kernelVersion),
+		"--cmdline", "@"+cmdlinePath,
+		"--os-release", filepath.Join(rootPath, "etc", "os-release"),
+		"--output", unsignedPath,
+	).Run()
+	if err != nil {
+		PrintVerbose("SystemdBootUKI.GenerateEntry:err(4): %s", err)
+		return "", err
+	}
+
+	ukiPath := unsignedPath
+	if settings.Cnf.SecureBoot.Enabled {
+		signer := NewSigner()
+		signedPath := filepath.Join(stageDir, espName(root)+".efi")
+
+		err = signer.Sign(unsignedPath, signedPath)
+		if err != nil {
+			PrintVerbose("SystemdBootUKI.GenerateEntry:err(6): %s", err)
+			return "", err
+		}
+
+		err = signer.Verify(signedPath)
+		if err != nil {
+			PrintVerbose("SystemdBootUKI.GenerateEntry:err(7): %s", err)
+			return "", err
+		}
+
+		ukiPath = signedPath
+	} else if settings.Cnf.SecureBoot.Enforce {
+		err = errors.New("refusing to promote an unsigned UKI: secure boot enforcement is enabled")
+		PrintVerbose("SystemdBootUKI.GenerateEntry:err(8): %s", err)
+		return "", err
+	}
+
+	// the recorded digest must be of the final artifact that actually
+	// lands on the ESP (the signed UKI, when signing is enabled), since
+	// verifyStagedDigest later recomputes it from that same file
+	digest, err := sha256Of(ukiPath)
+	if err != nil {
+		PrintVerbose("SystemdBootUKI.GenerateEntry:err(5): %s", err)
+		return "", err
+	}
+
+	genName := espName(root) + "-" + digest[:12]
+	ukiDst := filepath.Join(stageDir, genName+".efi")
+	if ukiPath != ukiDst {
+		err = os.Rename(ukiPath, ukiDst)
+		if err != nil {
+			PrintVerbose("SystemdBootUKI.GenerateEntry:err(9): %s", err)
+			return "", err
+		}
+	}
+
+	err = os.WriteFile(filepath.Join(stageDir, genName+".sha256"), []byte(digest), 0644)
+	if err != nil {
+		PrintVerbose("SystemdBootUKI.GenerateEntry:err(10): %s", err)
+		return "", err
+	}
+
+	entryConf := "title   " + entryName + "\n" +
+		"efi     /EFI/Linux/" + genName + ".efi\n"
+	entryPath := filepath.Join(stageDir, espName(root)+".conf")
+	err = os.WriteFile(entryPath, []byte(entryConf), 0644)
+	if err != nil {
+		PrintVerbose("SystemdBootUKI.GenerateEntry:err(11): %s", err)
+		return "", err
+	}
+
+	s.staged[strings.ToLower(root)] = stageDir
+
+	return digest, nil
+}
+
+// InstallFromChroot is a no-op for this backend: the UKI is fully
+// assembled by GenerateEntry, there is nothing left for the chroot's
+// own tooling to do
+func (s *SystemdBootUKI) InstallFromChroot(c *Chroot) error {
+	return nil
+}
+
+// AtomicPromote copies every staged UKI onto the ESP at bootMount under
+// its generation name, then promotes the matching loader entry with
+// promoteStagedFile (an AtomicSwap, as the GRUB backend does for
+// grub.cfg, once the entry exists), so a root switches to its new UKI in
+// a single step
+func (s *SystemdBootUKI) AtomicPromote(bootMount string) error {
+	PrintVerbose("SystemdBootUKI.AtomicPromote: running...")
+
+	linuxDir := filepath.Join(bootMount, "EFI", "Linux")
+	entriesDir := filepath.Join(bootMount, "loader", "entries")
+
+	err := os.MkdirAll(linuxDir, 0755)
+	if err != nil {
+		PrintVerbose("SystemdBootUKI.AtomicPromote:err: %s", err)
+		return err
+	}
+
+	err = os.MkdirAll(entriesDir, 0755)
+	if err != nil {
+		PrintVerbose("SystemdBootUKI.AtomicPromote:err(2): %s", err)
+		return err
+	}
+
+	for root, stageDir := range s.staged {
+		ukis, err := filepath.Glob(filepath.Join(stageDir, espName(root)+"-*.efi"))
+		if err != nil || len(ukis) != 1 {
+			err := errors.New("expected exactly one staged UKI for root " + root)
+			PrintVerbose("SystemdBootUKI.AtomicPromote:err(3): %s", err)
+			return err
+		}
+		genUki := ukis[0]
+		genName := strings.TrimSuffix(filepath.Base(genUki), ".efi")
+
+		confDst := filepath.Join(entriesDir, espName(root)+".conf")
+
+		err = copyStagedFile(genUki, filepath.Join(linuxDir, genName+".efi"))
+		if err != nil {
+			PrintVerbose("SystemdBootUKI.AtomicPromote:err(4): %s", err)
+			return err
+		}
+
+		err = copyStagedFile(filepath.Join(stageDir, genName+".sha256"), filepath.Join(linuxDir, genName+".sha256"))
+		if err != nil {
+			PrintVerbose("SystemdBootUKI.AtomicPromote:err(5): %s", err)
+			return err
+		}
+
+		err = verifyStagedDigest(filepath.Join(linuxDir, genName+".efi"), filepath.Join(linuxDir, genName+".sha256"))
+		if err != nil {
+			PrintVerbose("SystemdBootUKI.AtomicPromote:err(5.1): %s", err)
+			return err
+		}
+
+		// stageDir is not on the ESP, so the entry is first copied next to
+		// confDst, letting promoteStagedFile rename it on one filesystem
+		stagedConf := confDst + ".new"
+		err = copyStagedFile(filepath.Join(stageDir, espName(root)+".conf"), stagedConf)
+		if err != nil {
+			PrintVerbose("SystemdBootUKI.AtomicPromote:err(5.2): %s", err)
+			return err
+		}
+
+		err = promoteStagedFile(stagedConf, confDst)
+		if err != nil {
+			PrintVerbose("SystemdBootUKI.AtomicPromote:err(6): %s", err)
+			return err
+		}
+
+		os.RemoveAll(stageDir)
+
+		err = gcUkiGenerations(linuxDir, root)
+		if err != nil {
+			PrintVerbose("SystemdBootUKI.AtomicPromote:err(7): %s", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyStagedFile copies a staged file into its final location on the
+// ESP; generation-named UKIs never collide with an existing file, so a
+// plain copy (rather than AtomicSwap) is enough
+func copyStagedFile(src string, dst string) error {
+	bytes, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(dst, bytes, 0644)
+}
+
+// verifyStagedDigest recomputes ukiPath's sha256 and compares it against
+// the digest recorded in sha256Path by GenerateEntry, catching any
+// corruption introduced by copyStagedFile before the UKI is live on the
+// ESP
+func verifyStagedDigest(ukiPath string, sha256Path string) error {
+	recorded, err := os.ReadFile(sha256Path)
+	if err != nil {
+		return err
+	}
+
+	actual, err := sha256Of(ukiPath)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(string(recorded)) != actual {
+		return errors.New("sha256 mismatch for promoted UKI " + ukiPath)
+	}
+
+	return nil
+}
+
+// gcUkiGenerations keeps only the ukiGenerationsToKeep newest UKI (and
+// matching sha256) generations for root under linuxDir, deleting older
+// ones so the ESP doesn't fill up, modeled on Lanzaboote's generation
+// roots
+func gcUkiGenerations(linuxDir string, root string) error {
+	PrintVerbose("gcUkiGenerations: collecting stale generations for %s", root)
+
+	matches, err := filepath.Glob(filepath.Join(linuxDir, espName(root)+"-*.efi"))
+	if err != nil {
+		return err
+	}
+
+	if len(matches) <= ukiGenerationsToKeep {
+		return nil
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		fi, _ := os.Stat(matches[i])
+		fj, _ := os.Stat(matches[j])
+		if fi == nil || fj == nil {
+			return false
+		}
+		return fi.ModTime().After(fj.ModTime())
+	})
+
+	for _, stale := range matches[ukiGenerationsToKeep:] {
+		PrintVerbose("gcUkiGenerations: removing stale generation %s", stale)
+
+		err := os.Remove(stale)
+		if err != nil {
+			return err
+		}
+
+		sha256Path := strings.TrimSuffix(stale, ".efi") + ".sha256"
+		os.Remove(sha256Path)
+	}
+
+	return nil
+}
+
+// promoteStagedFile renames a staged file to dst+".future" and then
+// AtomicSwaps it with dst, or, when dst does not exist yet, simply
+// renames it into place. staged must be on the same filesystem as dst
+func promoteStagedFile(staged string, dst string) error {
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		return os.Rename(staged, dst)
+	}
+
+	futurePath := dst + ".future"
+	err := os.Rename(staged, futurePath)
+	if err != nil {
+		return err
+	}
+
+	return AtomicSwap(dst, futurePath)
+}
@@ -0,0 +1,79 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGcUkiGenerationsKeepsNewestGenerations(t *testing.T) {
+	linuxDir := t.TempDir()
+
+	generations := []string{"abroot-a-111111111111", "abroot-a-222222222222", "abroot-a-333333333333"}
+	for i, gen := range generations {
+		efiPath := filepath.Join(linuxDir, gen+".efi")
+		if err := os.WriteFile(efiPath, []byte("uki"), 0644); err != nil {
+			t.Fatalf("failed to write fixture: %s", err)
+		}
+		if err := os.WriteFile(filepath.Join(linuxDir, gen+".sha256"), []byte("digest"), 0644); err != nil {
+			t.Fatalf("failed to write fixture: %s", err)
+		}
+
+		// space out mtimes so the generations have a deterministic,
+		// oldest-to-newest order regardless of filesystem timestamp
+		// resolution
+		mtime := time.Now().Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(efiPath, mtime, mtime); err != nil {
+			t.Fatalf("failed to set mtime: %s", err)
+		}
+	}
+
+	if err := gcUkiGenerations(linuxDir, "a"); err != nil {
+		t.Fatalf("gcUkiGenerations() error = %s", err)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(linuxDir, "abroot-a-*.efi"))
+	if err != nil {
+		t.Fatalf("Glob() error = %s", err)
+	}
+	if len(matches) != ukiGenerationsToKeep {
+		t.Fatalf("gcUkiGenerations() left %d generations, want %d", len(matches), ukiGenerationsToKeep)
+	}
+
+	if _, err := os.Stat(filepath.Join(linuxDir, "abroot-a-111111111111.efi")); !os.IsNotExist(err) {
+		t.Error("gcUkiGenerations() did not remove the oldest generation")
+	}
+	if _, err := os.Stat(filepath.Join(linuxDir, "abroot-a-111111111111.sha256")); !os.IsNotExist(err) {
+		t.Error("gcUkiGenerations() did not remove the oldest generation's sha256")
+	}
+	if _, err := os.Stat(filepath.Join(linuxDir, "abroot-a-333333333333.efi")); err != nil {
+		t.Error("gcUkiGenerations() removed the newest generation")
+	}
+}
+
+func TestGcUkiGenerationsNoopBelowLimit(t *testing.T) {
+	linuxDir := t.TempDir()
+
+	efiPath := filepath.Join(linuxDir, "abroot-a-111111111111.efi")
+	if err := os.WriteFile(efiPath, []byte("uki"), 0644); err != nil {
+		t.Fatalf("failed to write fixture: %s", err)
+	}
+
+	if err := gcUkiGenerations(linuxDir, "a"); err != nil {
+		t.Fatalf("gcUkiGenerations() error = %s", err)
+	}
+
+	if _, err := os.Stat(efiPath); err != nil {
+		t.Error("gcUkiGenerations() removed a generation when at/below the keep limit")
+	}
+}
+
+func TestEspName(t *testing.T) {
+	if got := espName("A"); got != "abroot-a" {
+		t.Errorf("espName(A) = %q, want abroot-a", got)
+	}
+	if got := espName("b"); got != "abroot-b" {
+		t.Errorf("espName(b) = %q, want abroot-b", got)
+	}
+}
@@ -0,0 +1,55 @@
+package settings
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2023
+	Description:
+		Cnf holds ABRoot's runtime configuration, normally loaded from
+		/etc/abroot.json by the abroot CLI before any core package is
+		used.
+*/
+
+// Config is ABRoot's runtime configuration
+type Config struct {
+	// Registry, Name and Tag identify the OCI image ABSystem.Upgrade
+	// pulls from, e.g. registry.vanillaos.org/vanillaos/desktop:main
+	Registry string `json:"registry"`
+	Name     string `json:"name"`
+	Tag      string `json:"tag"`
+
+	// Bootloader selects the Bootloader backend NewBootloader returns:
+	// "grub" (the default) or "systemd-boot"/"uki"
+	Bootloader string `json:"bootloader"`
+
+	// SecureBoot configures UKI signing for the systemd-boot backend
+	SecureBoot SecureBootConfig `json:"secureBoot"`
+
+	// QemuStaticPath is the directory NewChroot looks in for the
+	// qemu-<arch>-static binaries used to emulate a foreign
+	// architecture; defaults to /usr/bin when empty
+	QemuStaticPath string `json:"qemuStaticPath"`
+}
+
+// SecureBootConfig configures Signer and SystemdBootUKI.GenerateEntry
+type SecureBootConfig struct {
+	// Enabled signs every generated UKI with DbKey/DbCert (or
+	// Pkcs11Uri, if set)
+	Enabled bool `json:"enabled"`
+
+	// Enforce refuses to promote an unsigned UKI when Enabled is false,
+	// instead of falling back to booting it unsigned
+	Enforce bool `json:"enforce"`
+
+	// DbKey and DbCert are the sbsigntool key pair used to sign UKIs
+	DbKey  string `json:"dbKey"`
+	DbCert string `json:"dbCert"`
+
+	// Pkcs11Uri, when set, is used in place of DbKey to sign via a
+	// PKCS#11 token (e.g. a hardware security module)
+	Pkcs11Uri string `json:"pkcs11Uri"`
+}
+
+// Cnf is the configuration in effect for this process
+var Cnf Config